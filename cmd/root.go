@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	config "github.com/wish/dev/config"
+	"github.com/wish/dev/reaper"
+)
+
+// Execute assembles the root `dev` command from appConfig's projects and
+// runs it. It calls reaper.RunKeepaliveIfRequested first, so a keepalive
+// re-exec of the binary takes over its handed-off reaper connection and
+// never reaches command parsing. Whatever the caller does before calling
+// Execute, such as loading appConfig and projects, still runs in the
+// keepalive process too.
+func Execute(appConfig *config.Dev, projects map[string]*config.Project) error {
+	reaper.RunKeepaliveIfRequested()
+
+	root := &cobra.Command{
+		Use:   "dev",
+		Short: "Manage local development environments",
+	}
+
+	for _, project := range projects {
+		projectCmd := &cobra.Command{
+			Use:   project.Name,
+			Short: "Manage the " + project.Name + " project",
+		}
+		projectCmd.AddCommand(
+			ProjectCmdUpCreate(appConfig, project),
+			ProjectCmdServicesCreate(appConfig, project),
+		)
+		root.AddCommand(projectCmd)
+	}
+
+	root.AddCommand(AllCmdCreate(appConfig, projects))
+
+	return root.Execute()
+}
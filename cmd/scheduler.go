@@ -0,0 +1,408 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	config "github.com/wish/dev/config"
+	"github.com/wish/dev/reaper"
+	"golang.org/x/sync/semaphore"
+)
+
+// defaultMaxParallel bounds how many independent project branches the
+// scheduler brings up at once when --max-parallel is not set.
+const defaultMaxParallel = 4
+
+// schedulerReaperLabel is the reaper session label used by `dev all up`,
+// which spans every selected project rather than just one.
+const schedulerReaperLabel = "all"
+
+// resolveGraph builds an adjacency map of project name -> the projects it
+// depends on (Project.DependsOn) for every project selected by only/skip,
+// plus any dependency they pull in transitively (even if that dependency
+// was itself named by --skip, it still has to come up for its dependents to
+// work). It returns an error if a dependency references an unknown project
+// or a cycle exists.
+func resolveGraph(projects map[string]*config.Project, only, skip []string) (map[string][]string, error) {
+	selected := selectProjects(projects, only, skip)
+
+	skipSet := make(map[string]bool, len(skip))
+	for _, name := range skip {
+		skipSet[name] = true
+	}
+
+	graph := make(map[string][]string, len(selected))
+	var addNode func(name string, requiredBy string) error
+	addNode = func(name string, requiredBy string) error {
+		if _, ok := graph[name]; ok {
+			return nil
+		}
+		project, ok := projects[name]
+		if !ok {
+			return errors.Errorf("unknown project %s", name)
+		}
+
+		if skipSet[name] {
+			log.Warnf("Project %s was given to --skip but is still required as a dependency of %s; bringing it up", name, requiredBy)
+		}
+
+		graph[name] = project.DependsOn
+		for _, dep := range project.DependsOn {
+			if err := addNode(dep, name); err != nil {
+				return errors.Wrapf(err, "project %s depends on %s", name, dep)
+			}
+		}
+		return nil
+	}
+
+	for name := range selected {
+		if err := addNode(name, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	if cycle := findCycle(graph); cycle != "" {
+		return nil, errors.Errorf("dependency cycle detected: %s", cycle)
+	}
+
+	return graph, nil
+}
+
+// selectProjects narrows the full set of configured projects down to those
+// named by --only, minus those named by --skip. An empty only list means
+// "every project".
+func selectProjects(projects map[string]*config.Project, only, skip []string) map[string]*config.Project {
+	skipSet := make(map[string]bool, len(skip))
+	for _, name := range skip {
+		skipSet[name] = true
+	}
+
+	selected := make(map[string]*config.Project, len(projects))
+	for name, project := range projects {
+		if len(only) > 0 && !contains(only, name) {
+			continue
+		}
+		if skipSet[name] {
+			continue
+		}
+		selected[name] = project
+	}
+	return selected
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findCycle does a DFS over graph and returns a human-readable description
+// of the first cycle it finds, or "" if the graph is acyclic.
+func findCycle(graph map[string][]string) string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int, len(graph))
+	var path []string
+
+	var visit func(name string) string
+	visit = func(name string) string {
+		state[name] = visiting
+		path = append(path, name)
+
+		for _, dep := range graph[name] {
+			switch state[dep] {
+			case visiting:
+				return strings.Join(append(path, dep), " -> ")
+			case unvisited:
+				if cycle := visit(dep); cycle != "" {
+					return cycle
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[name] = visited
+		return ""
+	}
+
+	for name := range graph {
+		if state[name] == unvisited {
+			if cycle := visit(name); cycle != "" {
+				return cycle
+			}
+		}
+	}
+	return ""
+}
+
+// SchedulerOpts configures a multi-project Up/Down run.
+type SchedulerOpts struct {
+	Only        []string
+	Skip        []string
+	MaxParallel int
+}
+
+// UpAll brings up every selected project and its dependencies, running
+// independent branches of the dependency graph in parallel (bounded by
+// opts.MaxParallel) while respecting topological order within a branch. A
+// single network map and registry login are shared across the whole run.
+func UpAll(appConfig *config.Dev, projects map[string]*config.Project, opts SchedulerOpts) error {
+	graph, err := resolveGraph(projects, opts.Only, opts.Skip)
+	if err != nil {
+		return err
+	}
+
+	maxParallel := opts.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = defaultMaxParallel
+	}
+
+	var r *reaper.Reaper
+	if !reaper.Disabled() && !appConfig.ReaperDisabled {
+		var err error
+		r, err = reaper.Start(schedulerReaperLabel, reaperConfig(appConfig))
+		if err != nil {
+			return errors.Wrap(err, "Error starting reaper")
+		}
+	}
+
+	registriesLogin(appConfig)
+	networkIDMap, err := networksCreate(appConfig, r)
+	if err != nil {
+		return errors.Wrap(err, "Error creating networks")
+	}
+
+	sched := &scheduler{
+		graph: graph,
+		sem:   semaphore.NewWeighted(int64(maxParallel)),
+		done:  make(map[string]chan struct{}, len(graph)),
+	}
+	for name := range graph {
+		sched.done[name] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(graph))
+
+	for name := range graph {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := sched.run(name, func(n string) error {
+				project := projects[n]
+				logger := log.WithField("project", n)
+				if err := verifyContainerConfig(appConfig, project, networkIDMap, r); err != nil {
+					return err
+				}
+				containerIDs, err := servicesCreate(appConfig, project, networkIDMap)
+				if err != nil {
+					return err
+				}
+				if r != nil {
+					for _, containerID := range containerIDs {
+						if err := r.Register("container", containerID); err != nil {
+							return errors.Wrapf(err, "Error registering service container %s with reaper", containerID)
+						}
+					}
+				}
+				return runDockerComposeLogged(logger, appConfig.ImagePrefix, "up", project.DockerComposeFilenames, "-d")
+			}); err != nil {
+				errs <- err
+			}
+		}(name)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DownAll tears down every selected project in reverse topological order,
+// i.e. a project is stopped only after everything that depends on it has
+// already been stopped.
+func DownAll(appConfig *config.Dev, projects map[string]*config.Project, opts SchedulerOpts) error {
+	graph, err := resolveGraph(projects, opts.Only, opts.Skip)
+	if err != nil {
+		return err
+	}
+
+	reverse := make(map[string][]string, len(graph))
+	for name := range graph {
+		reverse[name] = nil
+	}
+	for name, deps := range graph {
+		for _, dep := range deps {
+			reverse[dep] = append(reverse[dep], name)
+		}
+	}
+
+	maxParallel := opts.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = defaultMaxParallel
+	}
+
+	sched := &scheduler{
+		graph: reverse,
+		sem:   semaphore.NewWeighted(int64(maxParallel)),
+		done:  make(map[string]chan struct{}, len(reverse)),
+	}
+	for name := range reverse {
+		sched.done[name] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(reverse))
+
+	for name := range reverse {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := sched.run(name, func(n string) error {
+				project := projects[n]
+				logger := log.WithField("project", n)
+				if err := runDockerComposeLogged(logger, appConfig.ImagePrefix, "down", project.DockerComposeFilenames); err != nil {
+					return err
+				}
+				servicesDestroy(project)
+				return nil
+			}); err != nil {
+				errs <- err
+			}
+		}(name)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := reaper.Stop(schedulerReaperLabel); err != nil {
+		log.Warn(errors.Wrapf(err, "Error stopping reaper session for %s", schedulerReaperLabel))
+	}
+	return nil
+}
+
+// scheduler brings up or tears down a dependency graph, running each node
+// after every node it depends on (per graph) has finished, and at most
+// sem's weight worth of nodes concurrently. A node whose dependency failed
+// is skipped rather than run against a half-broken graph, and that failure
+// propagates to its own dependents in turn.
+type scheduler struct {
+	graph map[string][]string
+	sem   *semaphore.Weighted
+	done  map[string]chan struct{}
+	once  sync.Map
+	errs  sync.Map
+}
+
+// run waits for name's dependencies to finish, acquires a scheduling slot,
+// runs action for name exactly once, then signals name's own completion. If
+// any dependency failed, name is skipped and its own failure (wrapping the
+// dependency's) is recorded and returned so it propagates to whatever
+// depends on name.
+func (s *scheduler) run(name string, action func(string) error) error {
+	if _, alreadyRunning := s.once.LoadOrStore(name, struct{}{}); alreadyRunning {
+		<-s.done[name]
+		return s.loadErr(name)
+	}
+	defer close(s.done[name])
+
+	for _, dep := range s.graph[name] {
+		<-s.done[dep]
+		if depErr := s.loadErr(dep); depErr != nil {
+			err := errors.Wrapf(depErr, "skipping %s: dependency %s failed", name, dep)
+			s.errs.Store(name, err)
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	if err := s.sem.Acquire(ctx, 1); err != nil {
+		s.errs.Store(name, err)
+		return err
+	}
+	defer s.sem.Release(1)
+
+	if err := action(name); err != nil {
+		err = errors.Wrapf(err, "error running project %s", name)
+		s.errs.Store(name, err)
+		return err
+	}
+	return nil
+}
+
+// loadErr returns the failure recorded for name, if any.
+func (s *scheduler) loadErr(name string) error {
+	v, ok := s.errs.Load(name)
+	if !ok {
+		return nil
+	}
+	return v.(error)
+}
+
+// runDockerComposeLogged logs the docker-compose command line at debug level
+// through a field-tagged logger, then runs runDockerCompose and returns its
+// error. The docker-compose output itself is not routed through the logger
+// and carries no per-project tag.
+func runDockerComposeLogged(logger *log.Entry, imagePrefix, subcommand string, composeFilenames []string, args ...string) error {
+	logger.Debug(fmt.Sprintf("docker-compose %s %s", subcommand, strings.Join(args, " ")))
+	return runDockerCompose(imagePrefix, subcommand, composeFilenames, args...)
+}
+
+// AllCmdCreate constructs the 'all' command, which brings up or tears down
+// every configured project in dependency order, parallelizing independent
+// branches of the graph.
+func AllCmdCreate(appConfig *config.Dev, projects map[string]*config.Project) *cobra.Command {
+	var only, skip []string
+	var maxParallel int
+
+	all := &cobra.Command{
+		Use:   "all",
+		Short: "Bring up or down every project, respecting DependsOn order",
+	}
+
+	up := &cobra.Command{
+		Use:   "up",
+		Short: "Bring up every selected project and its dependencies",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return UpAll(appConfig, projects, SchedulerOpts{Only: only, Skip: skip, MaxParallel: maxParallel})
+		},
+	}
+
+	down := &cobra.Command{
+		Use:   "down",
+		Short: "Tear down every selected project in reverse dependency order",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DownAll(appConfig, projects, SchedulerOpts{Only: only, Skip: skip, MaxParallel: maxParallel})
+		},
+	}
+
+	for _, sub := range []*cobra.Command{up, down} {
+		sub.Flags().StringSliceVar(&only, "only", nil, "only bring up/down these projects (and their dependencies)")
+		sub.Flags().StringSliceVar(&skip, "skip", nil, "skip these projects unless required as a dependency")
+		sub.Flags().IntVar(&maxParallel, "max-parallel", defaultMaxParallel, "maximum number of projects to bring up/down concurrently")
+	}
+
+	all.AddCommand(up, down)
+	return all
+}
@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/sync/semaphore"
+
+	config "github.com/wish/dev/config"
+)
+
+func projectSet(dependsOn map[string][]string) map[string]*config.Project {
+	projects := make(map[string]*config.Project, len(dependsOn))
+	for name, deps := range dependsOn {
+		projects[name] = &config.Project{Name: name, DependsOn: deps}
+	}
+	return projects
+}
+
+func TestResolveGraph(t *testing.T) {
+	tests := []struct {
+		name     string
+		projects map[string][]string
+		only     []string
+		skip     []string
+		want     map[string][]string
+		wantErr  string
+	}{
+		{
+			name:     "no dependencies",
+			projects: map[string][]string{"a": nil, "b": nil},
+			want:     map[string][]string{"a": nil, "b": nil},
+		},
+		{
+			name:     "chain",
+			projects: map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil},
+			want:     map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil},
+		},
+		{
+			name:     "only narrows selection but keeps dependencies",
+			projects: map[string][]string{"a": {"b"}, "b": nil, "c": nil},
+			only:     []string{"a"},
+			want:     map[string][]string{"a": {"b"}, "b": nil},
+		},
+		{
+			name:     "skip is still pulled in as a dependency",
+			projects: map[string][]string{"a": {"b"}, "b": nil},
+			skip:     []string{"b"},
+			want:     map[string][]string{"a": {"b"}, "b": nil},
+		},
+		{
+			name:     "unknown dependency",
+			projects: map[string][]string{"a": {"nope"}},
+			wantErr:  "unknown project",
+		},
+		{
+			name:     "cycle",
+			projects: map[string][]string{"a": {"b"}, "b": {"a"}},
+			wantErr:  "dependency cycle detected",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveGraph(projectSet(tc.projects), tc.only, tc.skip)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("resolveGraph() error = %v, want containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveGraph() unexpected error: %s", err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("resolveGraph() = %v, want %v", got, tc.want)
+			}
+			for name, deps := range tc.want {
+				gotDeps, ok := got[name]
+				if !ok {
+					t.Fatalf("resolveGraph() missing node %s", name)
+				}
+				if strings.Join(gotDeps, ",") != strings.Join(deps, ",") {
+					t.Fatalf("resolveGraph()[%s] = %v, want %v", name, gotDeps, deps)
+				}
+			}
+		})
+	}
+}
+
+func TestFindCycle(t *testing.T) {
+	tests := []struct {
+		name      string
+		graph     map[string][]string
+		wantCycle bool
+	}{
+		{name: "acyclic", graph: map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil}},
+		{name: "self cycle", graph: map[string][]string{"a": {"a"}}, wantCycle: true},
+		{name: "multi-node cycle", graph: map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}, wantCycle: true},
+		{name: "disjoint acyclic branches", graph: map[string][]string{"a": nil, "b": {"a"}, "c": nil}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cycle := findCycle(tc.graph)
+			if tc.wantCycle && cycle == "" {
+				t.Fatalf("findCycle() = %q, want a cycle description", cycle)
+			}
+			if !tc.wantCycle && cycle != "" {
+				t.Fatalf("findCycle() = %q, want no cycle", cycle)
+			}
+		})
+	}
+}
+
+// TestSchedulerRunSkipsDependentsOnFailure exercises scheduler.run directly
+// against a graph of a -> b -> c plus an independent node d, where b fails:
+// a should be skipped (wrapping b's error) while c and the unrelated d
+// still run to completion.
+func TestSchedulerRunSkipsDependentsOnFailure(t *testing.T) {
+	graph := map[string][]string{
+		"a": {"b"},
+		"b": {"c"},
+		"c": nil,
+		"d": nil,
+	}
+
+	sched := &scheduler{
+		graph: graph,
+		sem:   semaphore.NewWeighted(2),
+		done:  make(map[string]chan struct{}, len(graph)),
+	}
+	for name := range graph {
+		sched.done[name] = make(chan struct{})
+	}
+
+	var ran sync.Map
+	results := make(map[string]error, len(graph))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name := range graph {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			err := sched.run(name, func(n string) error {
+				ran.Store(n, true)
+				if n == "b" {
+					return stringErr("b failed")
+				}
+				return nil
+			})
+			mu.Lock()
+			results[name] = err
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	if results["c"] != nil {
+		t.Fatalf("c should have run successfully, got %v", results["c"])
+	}
+	if results["d"] != nil {
+		t.Fatalf("d should have run successfully, got %v", results["d"])
+	}
+	if results["b"] == nil || !strings.Contains(results["b"].Error(), "b failed") {
+		t.Fatalf("b should have failed with its own error, got %v", results["b"])
+	}
+	if results["a"] == nil || !strings.Contains(results["a"].Error(), "skipping a") {
+		t.Fatalf("a should have been skipped because its dependency b failed, got %v", results["a"])
+	}
+	if !wasRun(&ran, "c") || !wasRun(&ran, "d") {
+		t.Fatalf("expected c and d's action to have run")
+	}
+	if wasRun(&ran, "a") {
+		t.Fatalf("a's action should not have run since its dependency failed")
+	}
+}
+
+func wasRun(ran *sync.Map, name string) bool {
+	_, ok := ran.Load(name)
+	return ok
+}
+
+type stringErr string
+
+func (e stringErr) Error() string { return string(e) }
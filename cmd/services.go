@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	config "github.com/wish/dev/config"
+	"github.com/wish/dev/docker"
+	"github.com/wish/dev/registry"
+)
+
+// defaultHealthcheckTimeout bounds how long we wait for a service container
+// to report healthy before giving up on Up.
+const defaultHealthcheckTimeout = 60 * time.Second
+
+// servicesCreate starts the short-lived service containers configured on the
+// project (databases, caches, brokers, etc.) on the given external networks
+// so docker-compose services can reach them by DNS alias before the project
+// itself comes up. It returns the container IDs it started so they can be
+// registered for cleanup, along with an error rather than exiting the
+// process so a single project's failure doesn't take a parallel `all up`
+// run down with it.
+func servicesCreate(appConfig *config.Dev, project *config.Project, networkIDMap map[string]string) ([]string, error) {
+	containerIDs := make([]string, 0, len(project.Services))
+	for name, svc := range project.Services {
+		if svc.Credentials.Name != "" || svc.Credentials.CredentialHelper != "" {
+			creds, err := registry.ResolveCredentials(registry.CredentialHelper(svc.Credentials.CredentialHelper),
+				svc.Credentials.URL, svc.Credentials.Name, svc.Credentials.Password)
+			if err == nil {
+				err = registry.Login(svc.Credentials.URL, creds.Username, creds.Password)
+			}
+			if err != nil {
+				return containerIDs, errors.Wrapf(err, "Failed to login for service %s", name)
+			}
+		}
+
+		containerID, err := docker.ContainerRun(docker.ContainerRunOpts{
+			Name:    project.Name + "_" + name,
+			Image:   svc.Image,
+			Env:     svc.Env,
+			Ports:   svc.Ports,
+			Options: svc.Options,
+			Alias:   name,
+		}, networkIDMap)
+		if err != nil {
+			return containerIDs, errors.Wrapf(err, "Error starting service %s", name)
+		}
+		log.Infof("Started service %s as %s", name, containerID)
+
+		if err := waitForHealthy(containerID, svc.Healthcheck, defaultHealthcheckTimeout); err != nil {
+			return containerIDs, errors.Wrapf(err, "Service %s did not become healthy", name)
+		}
+
+		containerIDs = append(containerIDs, containerID)
+	}
+	return containerIDs, nil
+}
+
+// servicesDestroy stops and removes every service container previously
+// started by servicesCreate for the project.
+func servicesDestroy(project *config.Project) {
+	for name := range project.Services {
+		containerName := project.Name + "_" + name
+		if err := docker.ContainerRemove(containerName); err != nil {
+			log.Warn(errors.Wrapf(err, "Error removing service %s", name))
+		}
+	}
+}
+
+// waitForHealthy polls the container's healthcheck status until it reports
+// healthy or the timeout elapses.
+func waitForHealthy(containerID string, hc config.Healthcheck, timeout time.Duration) error {
+	if hc.Test == "" {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	interval := hc.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	for time.Now().Before(deadline) {
+		healthy, err := docker.ContainerIsHealthy(containerID)
+		if err != nil {
+			return err
+		}
+		if healthy {
+			return nil
+		}
+		time.Sleep(interval)
+	}
+	return fmt.Errorf("timed out after %s waiting for container %s to be healthy", timeout, containerID)
+}
+
+// ProjectCmdServicesCreate constructs the 'services' command line option
+// available for each project, allowing the configured service containers to
+// be started and stopped independently of the full 'up'/'down' lifecycle.
+func ProjectCmdServicesCreate(appConfig *config.Dev, project *config.Project) *cobra.Command {
+	services := &cobra.Command{
+		Use:   "services",
+		Short: "Manage the " + project.Name + " service containers",
+	}
+
+	up := &cobra.Command{
+		Use:   "up",
+		Short: "Start the " + project.Name + " service containers",
+		Run: func(cmd *cobra.Command, args []string) {
+			networkIDMap, err := networksCreate(appConfig, nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if _, err := servicesCreate(appConfig, project, networkIDMap); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	down := &cobra.Command{
+		Use:   "down",
+		Short: "Stop the " + project.Name + " service containers",
+		Run: func(cmd *cobra.Command, args []string) {
+			servicesDestroy(project)
+		},
+	}
+
+	services.AddCommand(up, down)
+	return services
+}
@@ -2,47 +2,145 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/docker/docker/api/types"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/wish/dev/compose"
 	config "github.com/wish/dev/config"
 	"github.com/wish/dev/docker"
+	"github.com/wish/dev/reaper"
 	"github.com/wish/dev/registry"
 )
 
 // networksCreate creates any external network configured in the dev tool if
 // it does not exist already. It returns a map from name to the network id
-// of all the external networks.
-func networksCreate(appConfig *config.Dev) map[string]string {
+// of all the external networks. It returns an error rather than exiting the
+// process so a single project's failure doesn't take a parallel `all up`
+// run down with it.
+func networksCreate(appConfig *config.Dev, r *reaper.Reaper) (map[string]string, error) {
 	networkIDMap := make(map[string]string, len(appConfig.Networks))
 	for name, opts := range appConfig.Networks {
-		networkID, err := docker.NetworkIDFromName(name)
+		networkID, existing, err := docker.NetworkIDFromName(name)
 		if err != nil {
-			err = errors.Wrapf(err, "Error checking if network %s exists", name)
-			log.Fatal(err)
+			return nil, errors.Wrapf(err, "Error checking if network %s exists", name)
 		}
 
 		if networkID == "" {
 			networkID, err = docker.NetworkCreate(name, opts)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Error creating network %s", name)
+			}
 			log.Infof("Created %s network %s", name, networkID)
+		} else if mismatches := validateNetworkMatches(opts, existing); len(mismatches) > 0 {
+			networkID, err = reconcileNetworkMismatch(name, opts, networkID, existing, mismatches)
 			if err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 		} else {
 			log.Debugf("Network %s already exists with id %s", name, networkID)
 		}
 		networkIDMap[name] = networkID
+
+		if r != nil {
+			if err := r.Register("network", networkID); err != nil {
+				return nil, errors.Wrapf(err, "Error registering network %s with reaper", name)
+			}
+		}
+	}
+	return networkIDMap, nil
+}
+
+// validateNetworkMatches compares a configured network's desired driver,
+// IPAM subnets, attachable flag, and labels against an existing network of
+// the same name and returns a description of every field that diverges. An
+// empty result means the existing network satisfies the configuration.
+func validateNetworkMatches(opts config.Network, existing types.NetworkResource) []string {
+	var mismatches []string
+
+	if opts.Driver != "" && opts.Driver != existing.Driver {
+		mismatches = append(mismatches, fmt.Sprintf("driver: want %s, have %s", opts.Driver, existing.Driver))
+	}
+	if opts.Attachable && !existing.Attachable {
+		mismatches = append(mismatches, fmt.Sprintf("attachable: want %t, have %t", opts.Attachable, existing.Attachable))
+	}
+	for key, value := range opts.Labels {
+		if existing.Labels[key] != value {
+			mismatches = append(mismatches, fmt.Sprintf("label %s: want %s, have %s", key, value, existing.Labels[key]))
+		}
+	}
+
+	existingSubnets := make(map[string]bool, len(existing.IPAM.Config))
+	for _, ipamConfig := range existing.IPAM.Config {
+		existingSubnets[ipamConfig.Subnet] = true
+	}
+	for _, subnet := range opts.Subnets {
+		if !existingSubnets[subnet] {
+			mismatches = append(mismatches, fmt.Sprintf("subnet %s not present on existing network", subnet))
+		}
+	}
+
+	return mismatches
+}
+
+// reconcileNetworkMismatch acts on a detected drift between the configured
+// and existing network according to opts.OnMismatch ("fail", "warn", or
+// "recreate"), returning the network ID that should be used going forward.
+//
+// "recreate" tears down and rebuilds the network, which disconnects every
+// container currently attached to it - not just ones belonging to the
+// project running `up` right now. With a network map shared across a whole
+// `dev all up` run, that can include containers from other projects that
+// have nothing to do with this one, so existing's live attachments are
+// reconnected to the rebuilt network before we hand back its new ID.
+func reconcileNetworkMismatch(name string, opts config.Network, networkID string, existing types.NetworkResource, mismatches []string) (string, error) {
+	msg := fmt.Sprintf("Network %s does not match its configuration: %s", name, strings.Join(mismatches, "; "))
+
+	switch opts.OnMismatch {
+	case "recreate":
+		log.Warn(msg + "; recreating")
+
+		attachedContainers := make([]string, 0, len(existing.Containers))
+		for containerID := range existing.Containers {
+			attachedContainers = append(attachedContainers, containerID)
+		}
+
+		if err := docker.NetworkDisconnectAll(networkID); err != nil {
+			return "", errors.Wrapf(err, "Error disconnecting containers from network %s", name)
+		}
+		if err := docker.NetworkRemove(networkID); err != nil {
+			return "", errors.Wrapf(err, "Error removing network %s", name)
+		}
+		newNetworkID, err := docker.NetworkCreate(name, opts)
+		if err != nil {
+			return "", errors.Wrapf(err, "Error recreating network %s", name)
+		}
+		log.Infof("Recreated %s network %s", name, newNetworkID)
+
+		for _, containerID := range attachedContainers {
+			if err := docker.NetworkConnect(newNetworkID, containerID); err != nil {
+				return "", errors.Wrapf(err, "Error reconnecting container %s to recreated network %s", containerID, name)
+			}
+		}
+		return newNetworkID, nil
+	case "warn":
+		log.Warn(msg)
+		return networkID, nil
+	default:
+		return networkID, errors.New(msg)
 	}
-	return networkIDMap
 }
 
 // registriesLogin logs in to the specified registries. So we can fetch from
 // private registries.
 func registriesLogin(appConfig *config.Dev) {
 	for _, r := range appConfig.Registries {
-		err := registry.Login(r.URL, r.Name, r.Password)
+		creds, err := registry.ResolveCredentials(registry.CredentialHelper(r.CredentialHelper), r.URL, r.Name, r.Password)
+		if err == nil {
+			err = registry.Login(r.URL, creds.Username, creds.Password)
+		}
 		if err != nil {
 			msg := fmt.Sprintf("Failed to login to %s registry: %s", r.Name, err)
 			if r.ContinueOnFailure {
@@ -58,13 +156,16 @@ func registriesLogin(appConfig *config.Dev) {
 
 // createNetworkServiceMap creates a mapping from the networks configured by dev
 // to a list of the services that use them in the projects docker-compose files.
+// It also includes the project's own service-container sidecars (see
+// servicesCreate), since those are attached to every external network
+// directly rather than through a docker-compose file.
 func createNetworkServiceMap(devConfig *config.Dev, project *config.Project,
-	networkIDMap map[string]string) map[string][]string {
+	networkIDMap map[string]string) (map[string][]string, error) {
 	serviceNetworkMap := make(map[string][]string, len(devConfig.Networks))
 	for _, composeFilename := range project.DockerComposeFilenames {
 		composeConfig, err := compose.Parse(project.Directory, composeFilename)
 		if err != nil {
-			log.Fatal("Failed to parse docker-compose appConfig file: ", err)
+			return nil, errors.Wrap(err, "Failed to parse docker-compose appConfig file")
 		}
 
 		for _, service := range composeConfig.Services {
@@ -75,7 +176,15 @@ func createNetworkServiceMap(devConfig *config.Dev, project *config.Project,
 			}
 		}
 	}
-	return serviceNetworkMap
+
+	for serviceName := range project.Services {
+		containerName := project.Name + "_" + serviceName
+		for networkName := range networkIDMap {
+			serviceNetworkMap[networkName] = append(serviceNetworkMap[networkName], containerName)
+		}
+	}
+
+	return serviceNetworkMap, nil
 }
 
 // updateContainers performs container operations necessary to get the
@@ -85,28 +194,66 @@ func createNetworkServiceMap(devConfig *config.Dev, project *config.Project,
 // that no longer exists will not be able to start (docker-compose up will fail
 // when it attempts to start the container). These containers must be removed
 // before we attempt to start the container.
-func verifyContainerConfig(appConfig *config.Dev, project *config.Project, networkIDMap map[string]string) {
+func verifyContainerConfig(appConfig *config.Dev, project *config.Project, networkIDMap map[string]string, r *reaper.Reaper) error {
 	if len(networkIDMap) == 0 {
 		// no external networks, nothing to do
-		return
+		return nil
+	}
+
+	networkServiceMap, err := createNetworkServiceMap(appConfig, project, networkIDMap)
+	if err != nil {
+		return err
 	}
 
-	networkServiceMap := createNetworkServiceMap(appConfig, project, networkIDMap)
 	for networkName, services := range networkServiceMap {
 		networkID := networkIDMap[networkName]
-		err := docker.RemoveContainerIfRequired(networkName, networkID, services)
-		if err != nil {
-			log.Fatal(err)
+		if err := docker.RemoveContainerIfRequired(networkName, networkID, services); err != nil {
+			return err
+		}
+
+		if r != nil {
+			for _, service := range services {
+				if err := r.Register("container", service); err != nil {
+					return errors.Wrapf(err, "Error registering container %s with reaper", service)
+				}
+			}
 		}
 	}
+	return nil
 }
 
 // Up brings up the specified project with its dependencies and optionally
 // tails the logs of the project container.
 func Up(appConfig *config.Dev, project *config.Project, tailLogs bool) {
+	var r *reaper.Reaper
+	if !reaper.Disabled() && !appConfig.ReaperDisabled {
+		var err error
+		r, err = reaper.Start(project.Name, reaperConfig(appConfig))
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Error starting reaper"))
+		}
+	}
+
 	registriesLogin(appConfig)
-	networkIDMap := networksCreate(appConfig)
-	verifyContainerConfig(appConfig, project, networkIDMap)
+	networkIDMap, err := networksCreate(appConfig, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := verifyContainerConfig(appConfig, project, networkIDMap, r); err != nil {
+		log.Fatal(err)
+	}
+
+	containerIDs, err := servicesCreate(appConfig, project, networkIDMap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if r != nil {
+		for _, containerID := range containerIDs {
+			if err := r.Register("container", containerID); err != nil {
+				log.Fatal(errors.Wrapf(err, "Error registering service container %s with reaper", containerID))
+			}
+		}
+	}
 
 	runDockerCompose(appConfig.ImagePrefix, "up", project.DockerComposeFilenames, "-d")
 
@@ -115,6 +262,32 @@ func Up(appConfig *config.Dev, project *config.Project, tailLogs bool) {
 	}
 }
 
+// reaperConfig builds the reaper's connection timeouts from the app config,
+// falling back to reaper.DefaultConfig for anything left unset.
+func reaperConfig(appConfig *config.Dev) reaper.Config {
+	cfg := reaper.DefaultConfig
+	if appConfig.ReaperConnectionTimeout != 0 {
+		cfg.ConnectionTimeout = appConfig.ReaperConnectionTimeout
+	}
+	if appConfig.ReaperReconnectionTimeout != 0 {
+		cfg.ReconnectionTimeout = appConfig.ReaperReconnectionTimeout
+	}
+	return cfg
+}
+
+// Down stops the specified project, tears down any service containers that
+// were started for it by Up, and ends its reaper session (if any) so the
+// session's containers and networks are not reaped now that we're cleaning
+// them up ourselves.
+func Down(appConfig *config.Dev, project *config.Project) {
+	runDockerCompose(appConfig.ImagePrefix, "down", project.DockerComposeFilenames)
+	servicesDestroy(project)
+
+	if err := reaper.Stop(project.Name); err != nil {
+		log.Warn(errors.Wrapf(err, "Error stopping reaper session for %s", project.Name))
+	}
+}
+
 // ProjectCmdUpCreate constructs the 'up' command line option available for
 // each project.
 func ProjectCmdUpCreate(appConfig *config.Dev, project *config.Project) *cobra.Command {
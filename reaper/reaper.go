@@ -0,0 +1,325 @@
+// Package reaper launches and talks to a reaper sidecar container, modeled
+// on testcontainers-go's Ryuk, that guarantees dev's networks, containers,
+// and volumes get cleaned up even if the dev process itself dies or is
+// killed without running its normal teardown path. It is not the real Ryuk
+// image: registering resources follows Ryuk's line-oriented, one-ack-per-filter
+// wire protocol, but ending a session cleanly also needs an explicit
+// handshake that tells the sidecar "nothing to reap" (see Stop), which real
+// Ryuk has no equivalent of, so dev ships its own sidecar image speaking a
+// superset of Ryuk's protocol instead of running testcontainers/ryuk itself.
+//
+// A reaper session must survive longer than the one-shot `dev up` command
+// that creates it: the control connection is handed off to a small detached
+// keepalive process (via file-descriptor passing) so the session stays
+// alive after `dev up` exits normally, and is only closed out by `dev down`
+// calling Stop.
+package reaper
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/wish/dev/docker"
+)
+
+// reaperImage is the image used to run the reaper sidecar. It is dev's own
+// image rather than testcontainers/ryuk: it speaks Ryuk's filter/ack
+// protocol for registration but also understands the "DONE" handshake Stop
+// sends on a clean shutdown, which real Ryuk does not.
+const reaperImage = "wish/dev-reaper:latest"
+
+// DisabledEnvVar, when set to a truthy value, skips starting the reaper
+// entirely. Useful for environments that already guarantee cleanup (e.g. a
+// CI job that tears down its whole VM between runs).
+const DisabledEnvVar = "DEV_REAPER_DISABLED"
+
+// keepaliveArg is the hidden subcommand dev re-execs itself with to become
+// the detached process that holds the reaper connection open on behalf of a
+// command that has already exited. The root command must call
+// RunKeepaliveIfRequested before doing anything else.
+const keepaliveArg = "__dev-reaper-keepalive"
+
+// keepaliveSessionEnvVar carries the session ID through to the re-exec'd
+// keepalive process, since it owns no other state.
+const keepaliveSessionEnvVar = "DEV_REAPER_SESSION"
+
+// Config controls how long the reaper will wait for dev to (re)connect
+// before it assumes the process is gone and reaps everything it has been
+// told about.
+type Config struct {
+	// ConnectionTimeout is how long the reaper waits for the initial
+	// connection from dev before giving up and exiting.
+	ConnectionTimeout time.Duration
+	// ReconnectionTimeout is how long the reaper waits for dev to
+	// reconnect after a dropped connection before reaping.
+	ReconnectionTimeout time.Duration
+}
+
+// DefaultConfig mirrors the defaults testcontainers-go's Ryuk support uses.
+var DefaultConfig = Config{
+	ConnectionTimeout:   60 * time.Second,
+	ReconnectionTimeout: 10 * time.Second,
+}
+
+// Reaper is a handle to a running reaper sidecar container and its control
+// connection. Every network and container dev creates should be registered
+// with it so that an abnormal exit still leaves a clean slate.
+type Reaper struct {
+	SessionID   string
+	Label       string
+	containerID string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// sessionState is what gets persisted to disk so a later `dev down`
+// invocation, running as a brand new process, can find the keepalive
+// process for a session started by a previous `dev up`.
+type sessionState struct {
+	SessionID    string `json:"session_id"`
+	KeepalivePID int    `json:"keepalive_pid"`
+	ContainerID  string `json:"container_id"`
+}
+
+// Disabled reports whether the reaper has been turned off via the
+// DEV_REAPER_DISABLED environment variable.
+func Disabled() bool {
+	v := strings.ToLower(os.Getenv(DisabledEnvVar))
+	return v == "1" || v == "true" || v == "yes"
+}
+
+// Start launches the reaper sidecar for label (typically a project name, or
+// a shared label covering several projects) and blocks until it is ready to
+// accept registrations. It hands the control connection off to a detached
+// keepalive process so the session survives after the calling command
+// returns; call Stop(label) from the matching `down` to end it cleanly.
+func Start(label string, cfg Config) (*Reaper, error) {
+	sessionID := uuid.New().String()
+
+	containerID, port, err := docker.ContainerRunReaper(reaperImage, map[string]string{
+		"dev.session": sessionID,
+		"dev.project": label,
+	}, reaperEnv(cfg))
+	if err != nil {
+		return nil, errors.Wrap(err, "Error starting reaper container")
+	}
+
+	conn, err := dialWithTimeout(port, cfg.ConnectionTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error connecting to reaper")
+	}
+
+	if err := spawnKeepalive(sessionID, label, containerID, conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Error starting reaper keepalive process")
+	}
+
+	log.Debugf("Reaper %s ready for session %s", containerID, sessionID)
+	return &Reaper{
+		SessionID:   sessionID,
+		Label:       label,
+		containerID: containerID,
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+	}, nil
+}
+
+// Register tells the reaper to remove the given Docker resource (a
+// container name, network ID, or volume name) if dev goes away without
+// deregistering it first. label is one of "container", "network", or
+// "volume". Safe to call concurrently: the scheduler registers sidecars
+// for several projects in parallel against the same reaper connection.
+//
+// Ryuk's wire protocol is line-oriented and acks each filter line as it
+// receives it, so each line written here must be followed by its own read
+// of the ack before the next is sent - writing both lines up front and
+// reading only one ack back leaves the second ACK buffered to be
+// misread as the response to whatever Register call comes next.
+func (r *Reaper) Register(label, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	filters := []string{
+		fmt.Sprintf("label=dev.session=%s", r.SessionID),
+		fmt.Sprintf("%s=%s", label, value),
+	}
+	for _, filter := range filters {
+		if _, err := r.conn.Write([]byte(filter + "\n")); err != nil {
+			return errors.Wrapf(err, "Error registering %s %s with reaper", label, value)
+		}
+
+		ack, err := r.reader.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "Error reading reaper acknowledgement")
+		}
+		if strings.TrimSpace(ack) != "ACK" {
+			return fmt.Errorf("unexpected reaper response: %q", ack)
+		}
+	}
+	return nil
+}
+
+// Close closes this process's copy of the control connection. It does not
+// end the session: the detached keepalive process holds its own copy of the
+// connection open. Use Stop to actually end a session.
+func (r *Reaper) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.conn.Close()
+}
+
+// Stop ends the reaper session previously started under label: it signals
+// the detached keepalive process to tell the reaper the session finished
+// cleanly (so nothing gets reaped) and then exit, and removes the persisted
+// session state. It is a no-op if no session is running under label.
+func Stop(label string) error {
+	state, path, err := loadSessionState(label)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error reading reaper session state for %s", label)
+	}
+
+	if proc, err := os.FindProcess(state.KeepalivePID); err == nil {
+		if err := proc.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			log.Debugf("Reaper keepalive process %d for %s already gone: %s", state.KeepalivePID, label, err)
+		}
+	}
+
+	return os.Remove(path)
+}
+
+// reaperEnv translates cfg's timeouts into the environment variables the
+// reaper sidecar reads at startup, mirroring Ryuk's own RYUK_* env vars.
+// Without this, cfg's timeouts only ever took effect client-side (as the
+// dial deadline in dialWithTimeout), so the sidecar itself would still wait
+// out its compiled-in defaults before reaping.
+func reaperEnv(cfg Config) map[string]string {
+	return map[string]string{
+		"RYUK_CONNECTION_TIMEOUT":   cfg.ConnectionTimeout.String(),
+		"RYUK_RECONNECTION_TIMEOUT": cfg.ReconnectionTimeout.String(),
+	}
+}
+
+// dialWithTimeout keeps retrying the connection to the reaper's port until
+// it succeeds or timeout elapses.
+func dialWithTimeout(port int, timeout time.Duration) (net.Conn, error) {
+	addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Until(deadline))
+		if err == nil || !time.Now().Before(deadline) {
+			return conn, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// spawnKeepalive hands conn's underlying file descriptor to a detached
+// re-exec of the current binary and records enough state on disk for a
+// later `dev down` to find and stop it.
+func spawnKeepalive(sessionID, label, containerID string, conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return errors.New("reaper connection is not a *net.TCPConn, cannot hand it off")
+	}
+
+	connFile, err := tcpConn.File()
+	if err != nil {
+		return errors.Wrap(err, "Error duplicating reaper connection file descriptor")
+	}
+	defer connFile.Close()
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrap(err, "Error opening /dev/null for keepalive process")
+	}
+	defer devNull.Close()
+
+	cmd := exec.Command(os.Args[0], keepaliveArg)
+	cmd.Env = append(os.Environ(), keepaliveSessionEnvVar+"="+sessionID)
+	cmd.ExtraFiles = []*os.File{connFile}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = devNull, devNull, devNull
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "Error starting keepalive process")
+	}
+
+	return saveSessionState(label, sessionState{
+		SessionID:    sessionID,
+		KeepalivePID: cmd.Process.Pid,
+		ContainerID:  containerID,
+	})
+}
+
+// RunKeepaliveIfRequested checks whether this process invocation is the
+// hidden re-exec spawned by spawnKeepalive and, if so, takes over the
+// handed-off reaper connection and blocks until told to stop. It never
+// returns if it handles the invocation; the root command should call it
+// before doing anything else (e.g. at the top of main).
+func RunKeepaliveIfRequested() {
+	if len(os.Args) < 2 || os.Args[1] != keepaliveArg {
+		return
+	}
+
+	conn, err := net.FileConn(os.NewFile(3, "reaper-conn"))
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Error taking over reaper connection"))
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	<-sigCh
+
+	sessionID := os.Getenv(keepaliveSessionEnvVar)
+	fmt.Fprintf(conn, "DONE\n%s\n", sessionID)
+	conn.Close()
+	os.Exit(0)
+}
+
+func stateDir() string {
+	return filepath.Join(os.TempDir(), "dev-reaper")
+}
+
+func saveSessionState(label string, state sessionState) error {
+	if err := os.MkdirAll(stateDir(), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stateDir(), label+".json"), data, 0o644)
+}
+
+func loadSessionState(label string) (sessionState, string, error) {
+	path := filepath.Join(stateDir(), label+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return sessionState{}, path, err
+	}
+	var state sessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return sessionState{}, path, err
+	}
+	return state, path, nil
+}
@@ -0,0 +1,56 @@
+package reaper
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// TestRegisterAcksEachFilterLineInStep verifies Register reads back one ACK
+// per filter line it writes, matching Ryuk's line-oriented wire protocol. A
+// version that wrote every filter line up front and read back only one ACK
+// would leave the rest sitting unread in the buffer, ready to be misread as
+// the response to whatever Register call comes next.
+func TestRegisterAcksEachFilterLineInStep(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting mock reaper listener: %s", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		for {
+			if _, err := reader.ReadString('\n'); err != nil {
+				return
+			}
+			if _, err := conn.Write([]byte("ACK\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing mock reaper listener: %s", err)
+	}
+	defer clientConn.Close()
+
+	r := &Reaper{SessionID: "test-session", conn: clientConn, reader: bufio.NewReader(clientConn)}
+
+	for i := 0; i < 3; i++ {
+		if err := r.Register("container", fmt.Sprintf("container-%d", i)); err != nil {
+			t.Fatalf("Register #%d failed: %s", i, err)
+		}
+		if buffered := r.reader.Buffered(); buffered != 0 {
+			t.Fatalf("Register #%d left %d bytes of unread ACKs buffered; the next call would read a stale ack", i, buffered)
+		}
+	}
+}
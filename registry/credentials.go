@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CredentialHelper identifies how ephemeral registry credentials should be
+// obtained instead of reading a literal username/password out of config.
+//
+//   - "" (empty): use the literal Name/Password from config.Registry as-is.
+//   - "ecr": call the AWS SDK's GetAuthorizationToken for the registry's URL.
+//   - "gcloud": shell out to `gcloud auth print-access-token`.
+//   - anything else: treated as the suffix of a docker-credential-<helper>
+//     binary on PATH, speaking Docker's credential-helper protocol on stdio.
+type CredentialHelper string
+
+const (
+	// CredentialHelperECR obtains credentials via AWS ECR's
+	// GetAuthorizationToken API.
+	CredentialHelperECR CredentialHelper = "ecr"
+	// CredentialHelperGCloud obtains credentials via `gcloud auth
+	// print-access-token`.
+	CredentialHelperGCloud CredentialHelper = "gcloud"
+)
+
+// tokenTTL is how long a cached token from a given helper is considered
+// valid before ResolveCredentials treats it as stale and re-fetches it.
+// Helpers not listed here fall back to defaultTokenTTL.
+var tokenTTL = map[CredentialHelper]time.Duration{
+	CredentialHelperECR:    12 * time.Hour,
+	CredentialHelperGCloud: time.Hour,
+}
+
+// defaultTokenTTL is used for credential helpers with no entry in tokenTTL,
+// i.e. arbitrary docker-credential-<helper> binaries whose token lifetime
+// we have no way to know.
+const defaultTokenTTL = 12 * time.Hour
+
+// credentialHelperRequest is the JSON payload docker-credential-<helper>
+// binaries expect on stdin for the "get" action.
+type credentialHelperRequest struct {
+	ServerURL string `json:"ServerURL"`
+}
+
+// credentialHelperResponse is the JSON payload docker-credential-<helper>
+// binaries write to stdout in response to "get".
+type credentialHelperResponse struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// Credentials is an ephemeral username/password pair obtained from a
+// credential helper, along with when it was fetched and which helper
+// fetched it so callers can decide whether to refresh it.
+type Credentials struct {
+	Username  string
+	Password  string
+	FetchedAt time.Time
+	Helper    CredentialHelper
+}
+
+// Expired reports whether these credentials are old enough that they should
+// be re-fetched before use, per the issuing helper's own token lifetime.
+func (c Credentials) Expired() bool {
+	ttl, ok := tokenTTL[c.Helper]
+	if !ok {
+		ttl = defaultTokenTTL
+	}
+	return time.Since(c.FetchedAt) >= ttl
+}
+
+// credentialCache holds the last Credentials fetched per helper/url pair so
+// repeated logins (e.g. one per service container) don't re-invoke a helper
+// and mint a fresh token every time; entries are re-fetched once Expired.
+var (
+	credentialCacheMu sync.Mutex
+	credentialCache   = map[string]Credentials{}
+)
+
+// ResolveCredentials obtains a username/password for url using the named
+// helper. helper may be empty, in which case the literal name/password
+// provided are returned unchanged. Credentials obtained from a helper are
+// cached and reused until they expire.
+func ResolveCredentials(helper CredentialHelper, url, name, password string) (Credentials, error) {
+	if helper == "" {
+		return Credentials{Username: name, Password: password, FetchedAt: time.Now()}, nil
+	}
+
+	cacheKey := string(helper) + "|" + url
+
+	credentialCacheMu.Lock()
+	cached, ok := credentialCache[cacheKey]
+	credentialCacheMu.Unlock()
+	if ok && !cached.Expired() {
+		return cached, nil
+	}
+
+	var (
+		creds Credentials
+		err   error
+	)
+	switch helper {
+	case CredentialHelperECR:
+		creds, err = ecrCredentials(url)
+	case CredentialHelperGCloud:
+		creds, err = gcloudCredentials()
+	default:
+		creds, err = credentialHelperGet(string(helper), url)
+	}
+	if err != nil {
+		return Credentials{}, err
+	}
+	creds.Helper = helper
+
+	credentialCacheMu.Lock()
+	credentialCache[cacheKey] = creds
+	credentialCacheMu.Unlock()
+
+	return creds, nil
+}
+
+// credentialHelperGet invokes docker-credential-<helper> get, passing the
+// registry URL on stdin and parsing the JSON username/secret it writes to
+// stdout, per Docker's credential-helper protocol.
+func credentialHelperGet(helper, url string) (Credentials, error) {
+	req, err := json.Marshal(credentialHelperRequest{ServerURL: url})
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "Error marshalling credential helper request")
+	}
+
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = bytes.NewReader(req)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		return Credentials{}, errors.Wrapf(err, "Error running docker-credential-%s get", helper)
+	}
+
+	var resp credentialHelperResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return Credentials{}, errors.Wrapf(err, "Error parsing docker-credential-%s response", helper)
+	}
+
+	return Credentials{Username: resp.Username, Password: resp.Secret, FetchedAt: time.Now()}, nil
+}
+
+// gcloudCredentials shells out to the gcloud CLI to mint a short-lived
+// access token, used as the password against GCR/Artifact Registry with the
+// fixed username "oauth2accesstoken".
+func gcloudCredentials() (Credentials, error) {
+	cmd := exec.Command("gcloud", "auth", "print-access-token")
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		return Credentials{}, errors.Wrap(err, "Error running gcloud auth print-access-token")
+	}
+
+	return Credentials{
+		Username:  "oauth2accesstoken",
+		Password:  strings.TrimSpace(stdout.String()),
+		FetchedAt: time.Now(),
+	}, nil
+}
+
+// ecrCredentials calls AWS ECR's GetAuthorizationToken for the registry at
+// url and decodes the returned base64 "AWS:<password>" token into a
+// Credentials pair.
+func ecrCredentials(url string) (Credentials, error) {
+	token, err := ecrAuthorizationToken(url)
+	if err != nil {
+		return Credentials{}, errors.Wrapf(err, "Error fetching ECR authorization token for %s", url)
+	}
+
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 {
+		return Credentials{}, errors.New("Malformed ECR authorization token")
+	}
+
+	return Credentials{Username: parts[0], Password: parts[1], FetchedAt: time.Now()}, nil
+}
@@ -0,0 +1,106 @@
+package registry
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCredentialsExpired(t *testing.T) {
+	tests := []struct {
+		name      string
+		helper    CredentialHelper
+		elapsed   time.Duration
+		wantStale bool
+	}{
+		{name: "ecr well within its 12h ttl", helper: CredentialHelperECR, elapsed: time.Hour, wantStale: false},
+		{name: "ecr past its 12h ttl", helper: CredentialHelperECR, elapsed: 13 * time.Hour, wantStale: true},
+		{name: "gcloud within its 1h ttl", helper: CredentialHelperGCloud, elapsed: 30 * time.Minute, wantStale: false},
+		{name: "gcloud past its 1h ttl, still within ecr's 12h", helper: CredentialHelperGCloud, elapsed: 90 * time.Minute, wantStale: true},
+		{name: "unknown helper falls back to the 12h default", helper: CredentialHelper("docker-credential-fake"), elapsed: 13 * time.Hour, wantStale: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			creds := Credentials{Helper: tc.helper, FetchedAt: time.Now().Add(-tc.elapsed)}
+			if got := creds.Expired(); got != tc.wantStale {
+				t.Fatalf("Expired() = %t, want %t", got, tc.wantStale)
+			}
+		})
+	}
+}
+
+func TestResolveCredentialsNoHelperReturnsLiteral(t *testing.T) {
+	creds, err := ResolveCredentials("", "registry.example.com", "alice", "hunter2")
+	if err != nil {
+		t.Fatalf("ResolveCredentials() unexpected error: %s", err)
+	}
+	if creds.Username != "alice" || creds.Password != "hunter2" {
+		t.Fatalf("ResolveCredentials() = %+v, want literal name/password unchanged", creds)
+	}
+}
+
+func TestResolveCredentialsCacheHitSkipsTheHelper(t *testing.T) {
+	const helper = CredentialHelper("docker-credential-unreachable")
+	const url = "registry.example.com/cache-hit"
+	cacheKey := string(helper) + "|" + url
+
+	want := Credentials{Username: "cached-user", Password: "cached-pass", FetchedAt: time.Now(), Helper: helper}
+	credentialCacheMu.Lock()
+	credentialCache[cacheKey] = want
+	credentialCacheMu.Unlock()
+	t.Cleanup(func() {
+		credentialCacheMu.Lock()
+		delete(credentialCache, cacheKey)
+		credentialCacheMu.Unlock()
+	})
+
+	// helper isn't a real binary on PATH, so a cache miss here would fail the
+	// exec and surface as an error rather than silently falling through.
+	got, err := ResolveCredentials(helper, url, "ignored", "ignored")
+	if err != nil {
+		t.Fatalf("ResolveCredentials() unexpected error: %s", err)
+	}
+	if got != want {
+		t.Fatalf("ResolveCredentials() = %+v, want cached entry %+v", got, want)
+	}
+}
+
+func TestResolveCredentialsGenericHelperOverridesLiteral(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("credential helper stub script is a shell script")
+	}
+
+	const helper = "fake"
+	stubPath := writeCredentialHelperStub(t, helper, "stub-user", "stub-pass")
+	t.Setenv("PATH", filepath.Dir(stubPath)+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	creds, err := ResolveCredentials(helper, "registry.example.com/generic", "literal-name", "literal-pass")
+	if err != nil {
+		t.Fatalf("ResolveCredentials() unexpected error: %s", err)
+	}
+	if creds.Username != "stub-user" || creds.Password != "stub-pass" {
+		t.Fatalf("ResolveCredentials() = %+v, want the helper's credentials to override the literal name/password", creds)
+	}
+	if creds.Helper != helper {
+		t.Fatalf("ResolveCredentials().Helper = %q, want %q", creds.Helper, helper)
+	}
+}
+
+// writeCredentialHelperStub writes an executable docker-credential-<helper>
+// script to a temp directory that answers `get` per Docker's credential
+// helper protocol, and returns its path.
+func writeCredentialHelperStub(t *testing.T, helper CredentialHelper, username, password string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "docker-credential-"+string(helper))
+	script := fmt.Sprintf("#!/bin/sh\ncat <<EOF\n{\"Username\":%q,\"Secret\":%q}\nEOF\n", username, password)
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatalf("Error writing credential helper stub: %s", err)
+	}
+	return path
+}
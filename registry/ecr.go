@@ -0,0 +1,59 @@
+package registry
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/pkg/errors"
+)
+
+// ecrAuthorizationToken calls ECR's GetAuthorizationToken for the registry
+// host embedded in registryURL and returns the decoded "AWS:<password>"
+// basic-auth token.
+func ecrAuthorizationToken(registryURL string) (string, error) {
+	region, err := ecrRegionFromURL(registryURL)
+	if err != nil {
+		return "", err
+	}
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return "", errors.Wrap(err, "Error creating AWS session")
+	}
+
+	out, err := ecr.New(sess).GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return "", errors.Wrap(err, "Error calling GetAuthorizationToken")
+	}
+	if len(out.AuthorizationData) == 0 {
+		return "", errors.New("ECR returned no authorization data")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(out.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return "", errors.Wrap(err, "Error decoding ECR authorization token")
+	}
+
+	return string(decoded), nil
+}
+
+// ecrRegionFromURL extracts the AWS region from an ECR registry hostname of
+// the form "<account-id>.dkr.ecr.<region>.amazonaws.com".
+func ecrRegionFromURL(registryURL string) (string, error) {
+	host := registryURL
+	if u, err := url.Parse(registryURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	parts := strings.Split(host, ".")
+	for i, part := range parts {
+		if part == "ecr" && i+1 < len(parts) {
+			return parts[i+1], nil
+		}
+	}
+	return "", errors.Errorf("Could not determine AWS region from ECR URL %s", registryURL)
+}